@@ -0,0 +1,293 @@
+package podsecuritypolicy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	v3 "github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// pspCleanupFinalizerKey guards every PodSecurityPolicyTemplate so that Remove only ever runs
+	// to completion: if the handler crashes halfway through, the finalizer is still there on
+	// restart and Remove is retried until the active provider's ChildCount reports zero.
+	pspCleanupFinalizerKey = "podsecuritypolicy.rbac.user.cattle.io/pspt-cleanup"
+
+	// deploymentCleanupFinalizerKey is added to the Rancher controller Deployment whenever at
+	// least one PSPT still has outstanding children. If the PSPT CRD itself is removed while
+	// children still carry owner annotations/labels, this is the backstop that sweeps them.
+	deploymentCleanupFinalizerKey = "podsecuritypolicy.rbac.user.cattle.io/deployment-cleanup"
+
+	rancherNamespace      = "cattle-system"
+	rancherDeploymentName = "rancher"
+)
+
+// deploymentClient is the minimal surface finalizer.go needs to manage the Rancher controller
+// deployment's finalizer; it's satisfied by the generated appsv1 Deployment client.
+type deploymentClient interface {
+	Get(name string, options v1.GetOptions) (*appsv1.Deployment, error)
+	Update(deployment *appsv1.Deployment) (*appsv1.Deployment, error)
+}
+
+func hasFinalizer(finalizers []string, key string) bool {
+	for _, f := range finalizers {
+		if f == key {
+			return true
+		}
+	}
+	return false
+}
+
+func addFinalizer(finalizers []string, key string) []string {
+	if hasFinalizer(finalizers, key) {
+		return finalizers
+	}
+	return append(finalizers, key)
+}
+
+func removeFinalizer(finalizers []string, key string) []string {
+	result := finalizers[:0]
+	for _, f := range finalizers {
+		if f != key {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// ensurePSPTFinalizer adds pspCleanupFinalizerKey to obj if it isn't already present. It is safe
+// to call from both Create and Updated, since templates that existed before this finalizer was
+// introduced need it backfilled too.
+func ensurePSPTFinalizer(obj *v3.PodSecurityPolicyTemplate) *v3.PodSecurityPolicyTemplate {
+	if hasFinalizer(obj.Finalizers, pspCleanupFinalizerKey) {
+		return obj
+	}
+
+	newObj := obj.DeepCopy()
+	newObj.Finalizers = addFinalizer(newObj.Finalizers, pspCleanupFinalizerKey)
+	return newObj
+}
+
+// finalizeRemoval decides whether name's pspCleanupFinalizerKey can be released now that
+// providerName has been asked to remove its children: only once remainingChildren reports zero.
+// Kept separate from Lifecycle.Remove, and free of any client/lister dependency, so the
+// crash-in-the-middle case - a handler restart between provider.Remove succeeding and the
+// finalizer being cleared - can be exercised with plain values: finalizers come back untouched and
+// an error is returned, so Remove is simply retried against the same object on the next pass
+// instead of anything being orphaned.
+func finalizeRemoval(name string, finalizers []string, providerName Provider, remainingChildren int) ([]string, error) {
+	if remainingChildren > 0 {
+		return finalizers, fmt.Errorf("%v still has %v children left for provider %v, will retry", name, remainingChildren, providerName)
+	}
+	return removeFinalizer(finalizers, pspCleanupFinalizerKey), nil
+}
+
+// clusterSweepState is one downstream cluster's contribution to deploymentSweeper: its own PSPT
+// lister/interface and the providers active for it. The Rancher controller deployment is a single,
+// cluster-independent object, so deploymentSweeper must look across every registered cluster
+// before it can tell whether the deployment-level finalizer is still needed.
+type clusterSweepState struct {
+	psptLister v3.PodSecurityPolicyTemplateLister
+	pspti      v3.PodSecurityPolicyTemplateInterface
+	providers  []PolicyProvider
+}
+
+// deploymentSweeper is the backstop for PSPT deletions that never finish: if the Rancher
+// controller deployment carrying deploymentCleanupFinalizerKey is itself deleted, it sweeps every
+// registered cluster's providers/indexers directly (rather than relying on PSPT events, which may
+// never arrive again) and clears their per-PSPT finalizers before letting the deployment finalize.
+//
+// One deploymentSweeper is shared across every downstream cluster's RegisterTemplate call, because
+// the deployment it watches lives once, in the management scope - a sweeper built from only one
+// cluster's state would race other clusters' sweepers over the same finalizer and could strip it
+// while another cluster still had orphaned children.
+type deploymentSweeper struct {
+	deployments deploymentClient
+
+	mu       sync.Mutex
+	clusters map[string]clusterSweepState
+}
+
+func (s *deploymentSweeper) registerCluster(clusterName string, state clusterSweepState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clusters[clusterName] = state
+}
+
+func (s *deploymentSweeper) snapshot() []clusterSweepState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states := make([]clusterSweepState, 0, len(s.clusters))
+	for _, state := range s.clusters {
+		states = append(states, state)
+	}
+	return states
+}
+
+// sync is registered as a handler on every Deployment in rancherNamespace, since that's the
+// granularity the generic Deployment controller hands out - it must only ever act on the Rancher
+// controller deployment itself, or routine churn on an unrelated deployment in the same namespace
+// (an agent upgrade, reinstalling an app) would trigger a sweep of every cluster's PSPT children.
+func (s *deploymentSweeper) sync(key string, deployment *appsv1.Deployment) (*appsv1.Deployment, error) {
+	if deployment == nil || deployment.Name != rancherDeploymentName {
+		return deployment, nil
+	}
+
+	if deployment.DeletionTimestamp != nil {
+		if !hasFinalizer(deployment.Finalizers, deploymentCleanupFinalizerKey) {
+			return deployment, nil
+		}
+
+		if err := s.sweep(); err != nil {
+			return nil, fmt.Errorf("error sweeping pspt children during deployment teardown: %v", err)
+		}
+
+		newDeployment := deployment.DeepCopy()
+		newDeployment.Finalizers = removeFinalizer(newDeployment.Finalizers, deploymentCleanupFinalizerKey)
+		return s.deployments.Update(newDeployment)
+	}
+
+	outstanding, err := s.hasOutstandingChildren()
+	if err != nil {
+		return nil, err
+	}
+
+	hasFin := hasFinalizer(deployment.Finalizers, deploymentCleanupFinalizerKey)
+	if outstanding == hasFin {
+		return deployment, nil
+	}
+
+	newDeployment := deployment.DeepCopy()
+	if outstanding {
+		newDeployment.Finalizers = addFinalizer(newDeployment.Finalizers, deploymentCleanupFinalizerKey)
+	} else {
+		newDeployment.Finalizers = removeFinalizer(newDeployment.Finalizers, deploymentCleanupFinalizerKey)
+	}
+
+	return s.deployments.Update(newDeployment)
+}
+
+func (s *deploymentSweeper) hasOutstandingChildren() (bool, error) {
+	for _, cluster := range s.snapshot() {
+		templates, err := cluster.psptLister.List("", labels.Everything())
+		if err != nil {
+			return false, fmt.Errorf("error listing pod security policy templates: %v", err)
+		}
+
+		for _, template := range templates {
+			for _, provider := range cluster.providers {
+				count, err := provider.ChildCount(template)
+				if err != nil {
+					return false, err
+				}
+				if count > 0 {
+					return true, nil
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func (s *deploymentSweeper) sweep() error {
+	for _, cluster := range s.snapshot() {
+		templates, err := cluster.psptLister.List("", labels.Everything())
+		if err != nil {
+			return fmt.Errorf("error listing pod security policy templates: %v", err)
+		}
+
+		for _, template := range templates {
+			for _, provider := range cluster.providers {
+				count, err := provider.ChildCount(template)
+				if err != nil {
+					return err
+				}
+				if count == 0 {
+					continue
+				}
+				if err := provider.Remove(template); err != nil {
+					return fmt.Errorf("error removing children of %v from provider %v: %v", template.Name, provider.Name(), err)
+				}
+			}
+
+			if hasFinalizer(template.Finalizers, pspCleanupFinalizerKey) {
+				newTemplate := template.DeepCopy()
+				newTemplate.Finalizers = removeFinalizer(newTemplate.Finalizers, pspCleanupFinalizerKey)
+				if _, err := cluster.pspti.Update(newTemplate); err != nil {
+					return fmt.Errorf("error clearing finalizer on %v: %v", template.Name, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// sharedDeploymentSweeperMu guards construction of sharedDeploymentSweeper: every downstream
+// cluster's RegisterTemplate calls registerDeploymentSweeper, but only the first one should
+// actually create the sweeper and register its handler - the rest just contribute their cluster's
+// state to it.
+var (
+	sharedDeploymentSweeperMu sync.Mutex
+	sharedDeploymentSweeper   *deploymentSweeper
+)
+
+// registerDeploymentSweeper adds clusterName's PSPT lister/interface/providers to the single,
+// process-wide deploymentSweeper watching the Rancher controller deployment, creating that
+// sweeper (and registering its handler) on the first call. Later calls, one per additional
+// downstream cluster, only update the shared sweeper's view - they must not register a second,
+// independent handler, since that would let one cluster's sweeper strip the deployment's
+// cross-cluster finalizer while another cluster still had outstanding children.
+func registerDeploymentSweeper(ctx context.Context, clusterName string, deployments deploymentClient, deploymentController interface {
+	AddHandler(ctx context.Context, name string, handler func(string, *appsv1.Deployment) (*appsv1.Deployment, error))
+}, psptLister v3.PodSecurityPolicyTemplateLister, pspti v3.PodSecurityPolicyTemplateInterface, providers []PolicyProvider) {
+	if deployments == nil || deploymentController == nil {
+		logrus.Debugf("podsecuritypolicy: no deployment client available, skipping deployment-level cleanup finalizer")
+		return
+	}
+
+	sharedDeploymentSweeperMu.Lock()
+	if sharedDeploymentSweeper == nil {
+		sharedDeploymentSweeper = &deploymentSweeper{
+			deployments: deployments,
+			clusters:    map[string]clusterSweepState{},
+		}
+		deploymentController.AddHandler(ctx, "pspt-deployment-cleanup", sharedDeploymentSweeper.sync)
+	}
+	sweeper := sharedDeploymentSweeper
+	sharedDeploymentSweeperMu.Unlock()
+
+	sweeper.registerCluster(clusterName, clusterSweepState{
+		psptLister: psptLister,
+		pspti:      pspti,
+		providers:  providers,
+	})
+}
+
+// rancherDeployments returns a client for the Rancher controller deployment in the local cluster,
+// or nil if this UserContext has no route to it (e.g. it is itself the local cluster's context
+// during early bootstrap). Registration is best-effort: without it, per-PSPT finalizers are still
+// enforced, just not the deployment-level backstop.
+func rancherDeployments(uctx *config.UserContext) deploymentClient {
+	if uctx.Management.Apps == nil {
+		return nil
+	}
+	return uctx.Management.Apps.Deployments(rancherNamespace)
+}
+
+func rancherDeploymentController(uctx *config.UserContext) interface {
+	AddHandler(ctx context.Context, name string, handler func(string, *appsv1.Deployment) (*appsv1.Deployment, error))
+} {
+	if uctx.Management.Apps == nil {
+		return nil
+	}
+	return uctx.Management.Apps.Deployments(rancherNamespace).Controller()
+}
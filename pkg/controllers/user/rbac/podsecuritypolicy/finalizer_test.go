@@ -0,0 +1,55 @@
+package podsecuritypolicy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFinalizerHelpers(t *testing.T) {
+	const key = pspCleanupFinalizerKey
+
+	if hasFinalizer(nil, key) {
+		t.Errorf("hasFinalizer(nil) = true, want false")
+	}
+
+	added := addFinalizer(nil, key)
+	if !hasFinalizer(added, key) {
+		t.Errorf("addFinalizer did not add %v: %v", key, added)
+	}
+
+	if got := addFinalizer(added, key); !reflect.DeepEqual(got, added) {
+		t.Errorf("addFinalizer on an already-present key changed the slice: got %v, want %v", got, added)
+	}
+
+	removed := removeFinalizer(added, key)
+	if hasFinalizer(removed, key) {
+		t.Errorf("removeFinalizer did not remove %v: %v", key, removed)
+	}
+}
+
+// TestFinalizeRemovalCrashInTheMiddle covers the scenario registerDeploymentSweeper and
+// Lifecycle.Remove both exist to guard against: a handler crash (or any other interruption)
+// between a provider successfully deleting its children and the per-PSPT finalizer being cleared.
+func TestFinalizeRemovalCrashInTheMiddle(t *testing.T) {
+	finalizers := []string{pspCleanupFinalizerKey}
+
+	// provider.Remove has been called, but ChildCount still reports one straggler - as it would
+	// right after a crash mid-deletion. The finalizer must be left in place so Remove is retried.
+	got, err := finalizeRemoval("my-pspt", finalizers, ProviderPodSecurityPolicy, 1)
+	if err == nil {
+		t.Fatalf("finalizeRemoval with remainingChildren=1 returned no error")
+	}
+	if !reflect.DeepEqual(got, finalizers) {
+		t.Errorf("finalizeRemoval with remainingChildren=1 changed finalizers: got %v, want %v", got, finalizers)
+	}
+
+	// On retry, the straggler is gone: ChildCount reports zero and the finalizer can finally be
+	// released.
+	got, err = finalizeRemoval("my-pspt", finalizers, ProviderPodSecurityPolicy, 0)
+	if err != nil {
+		t.Fatalf("finalizeRemoval with remainingChildren=0 returned an error: %v", err)
+	}
+	if hasFinalizer(got, pspCleanupFinalizerKey) {
+		t.Errorf("finalizeRemoval with remainingChildren=0 left the finalizer in place: %v", got)
+	}
+}
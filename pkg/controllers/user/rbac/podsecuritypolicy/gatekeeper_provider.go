@@ -0,0 +1,314 @@
+package podsecuritypolicy
+
+import (
+	"fmt"
+	"strings"
+
+	v3 "github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// gatekeeperTemplateGroup is the API group ConstraintTemplates themselves live under.
+	gatekeeperTemplateGroup = "templates.gatekeeper.sh"
+	// gatekeeperConstraintGroup is the API group Gatekeeper registers a Constraint's CRD under
+	// once its ConstraintTemplate is reconciled - distinct from gatekeeperTemplateGroup.
+	gatekeeperConstraintGroup = "constraints.gatekeeper.sh"
+	gatekeeperVersion         = "v1beta1"
+
+	// pspParentLabel indexes rendered Constraints by the PSPT's permanent-id label (permanentid.go),
+	// the same stable join key podSecurityPolicyProvider uses for PodSecurityPolicies/ClusterRoles.
+	pspParentLabel = "podsecuritypolicy.cattle.io/pspt-parent"
+
+	constraintByPSPTParentIndex = "podsecuritypolicy.rbac.user.cattle.io/constraint-pspt-parent"
+)
+
+var (
+	constraintTemplateGVR = schema.GroupVersionResource{Group: gatekeeperTemplateGroup, Version: gatekeeperVersion, Resource: "constrainttemplates"}
+)
+
+// gatekeeperProvider renders an OPA Gatekeeper ConstraintTemplate, plus a single Constraint named
+// after it, in each downstream cluster it runs for, for clusters that have dropped the PodSecurityPolicy API. Gatekeeper's CRDs
+// aren't vendored as typed clients, so this provider talks to them through a dynamic client.
+type gatekeeperProvider struct {
+	client dynamic.Interface
+
+	constraintIndexer cache.Indexer
+}
+
+func (p *gatekeeperProvider) Name() Provider {
+	return ProviderGatekeeper
+}
+
+// Create renders obj's ConstraintTemplate and Constraint, creating whichever of the two don't
+// already exist. Each is checked and created independently rather than bailing out once either
+// exists, so a retry after a partial failure (e.g. the template got created but the constraint
+// create then failed) finishes provisioning the missing sibling instead of never touching it
+// again, since ChildCount would already be non-zero once Lifecycle stops calling Create.
+func (p *gatekeeperProvider) Create(obj *v3.PodSecurityPolicyTemplate) error {
+	if _, err := p.ensureConstraintTemplate(obj); err != nil {
+		return err
+	}
+	_, err := p.ensureConstraint(obj)
+	return err
+}
+
+func (p *gatekeeperProvider) ensureConstraintTemplate(obj *v3.PodSecurityPolicyTemplate) (created bool, err error) {
+	name := constraintTemplateName(obj)
+	if _, err := p.client.Resource(constraintTemplateGVR).Get(name, metaGetOptions()); err == nil {
+		return false, nil
+	} else if !apierrors.IsNotFound(err) {
+		return false, fmt.Errorf("error getting constraint template: %v", err)
+	}
+
+	ct, err := constraintTemplateForPSPT(obj)
+	if err != nil {
+		return false, fmt.Errorf("error rendering constraint template: %v", err)
+	}
+
+	if _, err := p.client.Resource(constraintTemplateGVR).Create(ct, metaCreateOptions()); err != nil {
+		return false, fmt.Errorf("error creating constraint template: %v", err)
+	}
+
+	return true, nil
+}
+
+func (p *gatekeeperProvider) ensureConstraint(obj *v3.PodSecurityPolicyTemplate) (created bool, err error) {
+	name := constraintTemplateName(obj)
+	if _, err := p.client.Resource(constraintGVR(obj)).Get(name, metaGetOptions()); err == nil {
+		return false, nil
+	} else if !apierrors.IsNotFound(err) {
+		return false, fmt.Errorf("error getting constraint: %v", err)
+	}
+
+	constraint, err := constraintForPSPT(obj)
+	if err != nil {
+		return false, fmt.Errorf("error rendering constraint: %v", err)
+	}
+
+	if _, err := p.client.Resource(constraintGVR(obj)).Create(constraint, metaCreateOptions()); err != nil {
+		return false, fmt.Errorf("error creating constraint: %v", err)
+	}
+
+	return true, nil
+}
+
+// Updated re-creates whichever of obj's ConstraintTemplate/Constraint is missing entirely - e.g.
+// because a prior Create only got partway through - then patches whichever existing ones are out
+// of date, so a template already past ChildCount==0 still ends up with a complete set of children.
+func (p *gatekeeperProvider) Updated(obj *v3.PodSecurityPolicyTemplate) error {
+	templateCreated, err := p.ensureConstraintTemplate(obj)
+	if err != nil {
+		return err
+	}
+
+	rawConstraints, err := p.constraintIndexer.ByIndex(constraintByPSPTParentIndex, permanentID(obj))
+	if err != nil {
+		return fmt.Errorf("error getting constraints: %v", err)
+	}
+
+	if !templateCreated {
+		ct, err := constraintTemplateForPSPT(obj)
+		if err != nil {
+			return fmt.Errorf("error rendering constraint template: %v", err)
+		}
+
+		if _, err := p.client.Resource(constraintTemplateGVR).Update(ct, metaUpdateOptions()); err != nil {
+			return fmt.Errorf("error updating constraint template: %v", err)
+		}
+	}
+
+	if _, err := p.ensureConstraint(obj); err != nil {
+		return err
+	}
+
+	for _, rawConstraint := range rawConstraints {
+		constraint := rawConstraint.(*unstructured.Unstructured)
+		if constraint.GetAnnotations()[podSecurityPolicyTemplateVersionAnnotation] == obj.ResourceVersion {
+			continue
+		}
+
+		rendered, err := constraintForPSPT(obj)
+		if err != nil {
+			return fmt.Errorf("error rendering constraint: %v", err)
+		}
+		rendered.SetName(constraint.GetName())
+		rendered.SetResourceVersion(constraint.GetResourceVersion())
+
+		if _, err := p.client.Resource(constraintGVR(obj)).Update(rendered, metaUpdateOptions()); err != nil {
+			return fmt.Errorf("error updating constraint: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (p *gatekeeperProvider) Remove(obj *v3.PodSecurityPolicyTemplate) error {
+	rawConstraints, err := p.constraintIndexer.ByIndex(constraintByPSPTParentIndex, permanentID(obj))
+	if err != nil {
+		return fmt.Errorf("error getting constraints: %v", err)
+	}
+
+	for _, rawConstraint := range rawConstraints {
+		constraint := rawConstraint.(*unstructured.Unstructured)
+		if err := p.client.Resource(constraintGVR(obj)).Delete(constraint.GetName(), metaDeleteOptions()); err != nil {
+			return fmt.Errorf("error deleting constraint: %v", err)
+		}
+	}
+
+	if err := p.client.Resource(constraintTemplateGVR).Delete(constraintTemplateName(obj), metaDeleteOptions()); err != nil {
+		return fmt.Errorf("error deleting constraint template: %v", err)
+	}
+
+	return nil
+}
+
+func (p *gatekeeperProvider) ChildCount(obj *v3.PodSecurityPolicyTemplate) (int, error) {
+	constraints, err := p.constraintIndexer.ByIndex(constraintByPSPTParentIndex, permanentID(obj))
+	if err != nil {
+		return 0, fmt.Errorf("error getting constraints: %v", err)
+	}
+
+	return len(constraints), nil
+}
+
+// constraintByPSPTParent indexes Constraints by the permanent-id label stamped on them in
+// constraintForPSPT, mirroring how PodSecurityPolicies/ClusterRoles are indexed.
+func constraintByPSPTParent(obj interface{}) ([]string, error) {
+	constraint, ok := obj.(*unstructured.Unstructured)
+	if !ok || constraint.GetLabels()[pspParentLabel] == "" {
+		return []string{}, nil
+	}
+
+	return []string{constraint.GetLabels()[pspParentLabel]}, nil
+}
+
+func constraintTemplateName(obj *v3.PodSecurityPolicyTemplate) string {
+	return "pspt-" + obj.Name
+}
+
+// constraintKind is the CRD kind Gatekeeper generates from a ConstraintTemplate's CRD spec; it is
+// what Constraints reference in their own apiVersion/kind.
+func constraintKind(obj *v3.PodSecurityPolicyTemplate) string {
+	return "Pspt" + obj.Name
+}
+
+// constraintGVR is the GroupVersionResource Gatekeeper exposes for a Constraint once it has
+// reconciled the matching ConstraintTemplate: group constraints.gatekeeper.sh, resource the
+// lowercased plural of the ConstraintTemplate's CRD kind (constraintKind).
+func constraintGVR(obj *v3.PodSecurityPolicyTemplate) schema.GroupVersionResource {
+	return schema.GroupVersionResource{
+		Group:    gatekeeperConstraintGroup,
+		Version:  gatekeeperVersion,
+		Resource: strings.ToLower(constraintKind(obj)) + "s",
+	}
+}
+
+// constraintTemplateForPSPT renders obj into a Gatekeeper ConstraintTemplate whose Rego body
+// enforces the same set of fields a policyv1beta1.PodSecurityPolicy would (runAsUser, seLinux,
+// fsGroup, supplementalGroups, privileged, allowedCapabilities, volumes, hostNetwork/PID/IPC,
+// readOnlyRootFilesystem). The Rego itself is shipped as an embedded asset in rego.go.
+func constraintTemplateForPSPT(obj *v3.PodSecurityPolicyTemplate) (*unstructured.Unstructured, error) {
+	ct := &unstructured.Unstructured{}
+	ct.SetAPIVersion(gatekeeperTemplateGroup + "/" + gatekeeperVersion)
+	ct.SetKind("ConstraintTemplate")
+	ct.SetName(constraintTemplateName(obj))
+	ct.SetLabels(map[string]string{pspParentLabel: permanentID(obj)})
+	ct.SetAnnotations(map[string]string{podSecurityPolicyTemplateVersionAnnotation: obj.ResourceVersion})
+
+	if err := unstructured.SetNestedField(ct.Object, constraintKind(obj), "spec", "crd", "spec", "names", "kind"); err != nil {
+		return nil, err
+	}
+
+	// spec.targets is a list of {target, rego} entries, not a map - Gatekeeper's ConstraintTemplate
+	// CRD schema rejects anything else.
+	targets := []interface{}{
+		map[string]interface{}{
+			"target": "admission.k8s.gatekeeper.sh",
+			"rego":   pspRegoAsset,
+		},
+	}
+	if err := unstructured.SetNestedSlice(ct.Object, targets, "spec", "targets"); err != nil {
+		return nil, err
+	}
+
+	return ct, nil
+}
+
+// constraintForPSPT renders the Constraint that binds a ConstraintTemplate to workloads, carrying
+// the actual PSPT field values as the Rego rule's `parameters`.
+func constraintForPSPT(obj *v3.PodSecurityPolicyTemplate) (*unstructured.Unstructured, error) {
+	c := &unstructured.Unstructured{}
+	c.SetAPIVersion(gatekeeperConstraintGroup + "/" + gatekeeperVersion)
+	c.SetKind(constraintKind(obj))
+	c.SetName(constraintTemplateName(obj))
+	c.SetLabels(map[string]string{pspParentLabel: permanentID(obj)})
+	c.SetAnnotations(map[string]string{podSecurityPolicyTemplateVersionAnnotation: obj.ResourceVersion})
+
+	params, err := pspSpecToRegoParameters(obj.Spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := unstructured.SetNestedMap(c.Object, params, "spec", "parameters"); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// pspSpecToRegoParameters maps the fields of a policyv1beta1.PodSecurityPolicySpec onto the
+// `parameters` block the embedded Rego in rego.go expects.
+func pspSpecToRegoParameters(spec policyv1beta1.PodSecurityPolicySpec) (map[string]interface{}, error) {
+	params := map[string]interface{}{
+		"privileged":             spec.Privileged,
+		"readOnlyRootFilesystem": spec.ReadOnlyRootFilesystem,
+		"hostNetwork":            spec.HostNetwork,
+		"hostPID":                spec.HostPID,
+		"hostIPC":                spec.HostIPC,
+		"runAsUserRule":          string(spec.RunAsUser.Rule),
+		"seLinuxRule":            string(spec.SELinux.Rule),
+		"fsGroupRule":            string(spec.FSGroup.Rule),
+		"supplementalGroupsRule": string(spec.SupplementalGroups.Rule),
+	}
+
+	var allowedCapabilities []interface{}
+	for _, c := range spec.AllowedCapabilities {
+		allowedCapabilities = append(allowedCapabilities, string(c))
+	}
+	params["allowedCapabilities"] = allowedCapabilities
+
+	var volumes []interface{}
+	for _, v := range spec.Volumes {
+		volumes = append(volumes, string(v))
+	}
+	params["volumes"] = volumes
+
+	return params, nil
+}
+
+func logGatekeeperFallback(err error) {
+	logrus.Warnf("gatekeeper provider: %v", err)
+}
+
+func metaGetOptions() v1.GetOptions {
+	return v1.GetOptions{}
+}
+
+func metaCreateOptions() v1.CreateOptions {
+	return v1.CreateOptions{}
+}
+
+func metaUpdateOptions() v1.UpdateOptions {
+	return v1.UpdateOptions{}
+}
+
+func metaDeleteOptions() *v1.DeleteOptions {
+	return &v1.DeleteOptions{}
+}
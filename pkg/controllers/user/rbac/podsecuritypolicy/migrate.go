@@ -0,0 +1,87 @@
+package podsecuritypolicy
+
+import (
+	"fmt"
+
+	v3 "github.com/rancher/types/apis/management.cattle.io/v3"
+	v1beta12 "github.com/rancher/types/apis/policy/v1beta1"
+	v12 "github.com/rancher/types/apis/rbac.authorization.k8s.io/v1"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// migratePermanentIDs runs once at startup, before the label-based indexers in psp_provider.go take
+// over. PodSecurityPolicies and ClusterRoles were historically joined back to their
+// PodSecurityPolicyTemplate purely through the mutable podSecurityPolicyTemplateParentAnnotation;
+// this backfills permanentIDLabel onto every template and every child still discovered via that
+// legacy annotation, so existing deployments don't lose their parent relationship on upgrade.
+func migratePermanentIDs(pspti v3.PodSecurityPolicyTemplateInterface, psptLister v3.PodSecurityPolicyTemplateLister,
+	policies v1beta12.PodSecurityPolicyInterface, policyLister v1beta12.PodSecurityPolicyLister,
+	clusterRoles v12.ClusterRoleInterface, clusterRoleLister v12.ClusterRoleLister) error {
+	templates, err := psptLister.List("", labels.Everything())
+	if err != nil {
+		return fmt.Errorf("error listing pod security policy templates: %v", err)
+	}
+
+	allPolicies, err := policyLister.List("", labels.Everything())
+	if err != nil {
+		return fmt.Errorf("error listing pod security policies: %v", err)
+	}
+
+	allClusterRoles, err := clusterRoleLister.List("", labels.Everything())
+	if err != nil {
+		return fmt.Errorf("error listing cluster roles: %v", err)
+	}
+
+	for _, template := range templates {
+		if template.Labels[permanentIDLabel] == "" {
+			migrated := ensurePermanentID(template)
+			stored, err := pspti.Update(migrated)
+			if err != nil {
+				return fmt.Errorf("error backfilling permanent-id on template %v: %v", template.Name, err)
+			}
+			template = stored
+			logrus.Infof("podsecuritypolicy: backfilled permanent-id on template %v", template.Name)
+		}
+
+		id := permanentID(template)
+
+		for _, policy := range allPolicies {
+			if policy.Annotations[podSecurityPolicyTemplateParentAnnotation] != template.Name {
+				continue
+			}
+			if policy.Labels[permanentIDLabel] == id {
+				continue
+			}
+
+			newPolicy := policy.DeepCopy()
+			if newPolicy.Labels == nil {
+				newPolicy.Labels = map[string]string{}
+			}
+			newPolicy.Labels[permanentIDLabel] = id
+			if _, err := policies.Update(newPolicy); err != nil {
+				return fmt.Errorf("error backfilling permanent-id on policy %v: %v", policy.Name, err)
+			}
+		}
+
+		for _, clusterRole := range allClusterRoles {
+			if clusterRole.Annotations[podSecurityPolicyTemplateParentAnnotation] != template.Name {
+				continue
+			}
+			if clusterRole.Labels[permanentIDLabel] == id {
+				continue
+			}
+
+			newClusterRole := clusterRole.DeepCopy()
+			if newClusterRole.Labels == nil {
+				newClusterRole.Labels = map[string]string{}
+			}
+			newClusterRole.Labels[permanentIDLabel] = id
+			if _, err := clusterRoles.Update(newClusterRole); err != nil {
+				return fmt.Errorf("error backfilling permanent-id on cluster role %v: %v", clusterRole.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package podsecuritypolicy
+
+import (
+	v3 "github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+// permanentIDLabel is a stable identifier stamped on a PodSecurityPolicyTemplate and every object
+// derived from it. Unlike the template's name, it survives renames and re-imports, so it's what
+// the indexers in psp_provider.go and gatekeeper_provider.go join children against.
+const permanentIDLabel = "podsecuritypolicy.cattle.io/permanent-id"
+
+// permanentID returns the stable id stamped on obj, or "" if it hasn't been assigned one yet
+// (this can only happen for templates created before this label existed and not yet migrated).
+func permanentID(obj *v3.PodSecurityPolicyTemplate) string {
+	return obj.Labels[permanentIDLabel]
+}
+
+// ensurePermanentID stamps obj with a permanent-id label if it doesn't already have one.
+func ensurePermanentID(obj *v3.PodSecurityPolicyTemplate) *v3.PodSecurityPolicyTemplate {
+	if obj.Labels[permanentIDLabel] != "" {
+		return obj
+	}
+
+	newObj := obj.DeepCopy()
+	if newObj.Labels == nil {
+		newObj.Labels = map[string]string{}
+	}
+	newObj.Labels[permanentIDLabel] = string(uuid.NewUUID())
+	return newObj
+}
@@ -0,0 +1,51 @@
+package podsecuritypolicy
+
+import (
+	v3 "github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+// Provider names a PolicyProvider implementation. Stored on Cluster.Spec so that each downstream
+// cluster can pick how PodSecurityPolicyTemplates are enforced on it.
+type Provider string
+
+const (
+	// ProviderPodSecurityPolicy renders a policyv1beta1.PodSecurityPolicy and a backing ClusterRole.
+	// This is the default and matches Rancher's historical behavior.
+	ProviderPodSecurityPolicy Provider = "pod-security-policy"
+	// ProviderGatekeeper renders an OPA Gatekeeper ConstraintTemplate and Constraints, for clusters
+	// where the PodSecurityPolicy API is no longer available (Kubernetes 1.25+).
+	ProviderGatekeeper Provider = "gatekeeper"
+)
+
+// PolicyProvider translates a PodSecurityPolicyTemplate into whatever admission-control objects a
+// downstream cluster actually enforces, and keeps them in sync with the template. Lifecycle fans
+// out Create/Updated/Remove to whichever provider is active for the cluster it is running in.
+type PolicyProvider interface {
+	// Name identifies the provider; it is matched against Cluster.Spec.PodSecurityPolicyTemplateProvider.
+	Name() Provider
+	Create(obj *v3.PodSecurityPolicyTemplate) error
+	Updated(obj *v3.PodSecurityPolicyTemplate) error
+	Remove(obj *v3.PodSecurityPolicyTemplate) error
+	// ChildCount reports how many derived objects still reference obj, so Remove can confirm
+	// cleanup actually finished before releasing its finalizer.
+	ChildCount(obj *v3.PodSecurityPolicyTemplate) (int, error)
+}
+
+// activeProvider picks the PolicyProvider configured for the cluster this controller is running
+// against, falling back to the PodSecurityPolicy provider when the cluster hasn't opted into
+// anything else (or requested a provider we don't know about).
+func activeProvider(providers []PolicyProvider, clusterProviderName string) PolicyProvider {
+	for _, p := range providers {
+		if string(p.Name()) == clusterProviderName {
+			return p
+		}
+	}
+
+	for _, p := range providers {
+		if p.Name() == ProviderPodSecurityPolicy {
+			return p
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package podsecuritypolicy
+
+import (
+	"fmt"
+
+	v3 "github.com/rancher/types/apis/management.cattle.io/v3"
+	v1beta12 "github.com/rancher/types/apis/policy/v1beta1"
+	v12 "github.com/rancher/types/apis/rbac.authorization.k8s.io/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	rbac "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podSecurityPolicyProvider is the original PolicyProvider: it renders a policyv1beta1.PodSecurityPolicy
+// and a backing ClusterRole for every PodSecurityPolicyTemplate, and keeps them up to date.
+type podSecurityPolicyProvider struct {
+	policies          v1beta12.PodSecurityPolicyInterface
+	policyLister      v1beta12.PodSecurityPolicyLister
+	clusterRoles      v12.ClusterRoleInterface
+	clusterRoleLister v12.ClusterRoleLister
+
+	policyIndexer      cache.Indexer
+	clusterRoleIndexer cache.Indexer
+}
+
+func (p *podSecurityPolicyProvider) Name() Provider {
+	return ProviderPodSecurityPolicy
+}
+
+// Create renders obj's PodSecurityPolicy and ClusterRole, creating whichever of the two don't
+// already exist. Each is checked and created independently rather than bailing out once either
+// exists, so a retry after a partial failure (e.g. the policy got created but the cluster role
+// create then failed) finishes provisioning the missing sibling instead of never touching it
+// again, since ChildCount would already be non-zero once Lifecycle stops calling Create.
+func (p *podSecurityPolicyProvider) Create(obj *v3.PodSecurityPolicyTemplate) error {
+	if err := p.ensurePolicy(obj); err != nil {
+		return err
+	}
+	return p.ensureClusterRole(obj)
+}
+
+func (p *podSecurityPolicyProvider) ensurePolicy(obj *v3.PodSecurityPolicyTemplate) error {
+	if _, err := p.policyLister.Get("", obj.Name); err == nil {
+		return nil
+	} else if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error getting psp %v: %v", obj.Name, err)
+	}
+
+	policy := &policyv1beta1.PodSecurityPolicy{
+		ObjectMeta: v1.ObjectMeta{
+			Name: obj.Name,
+			Labels: map[string]string{
+				permanentIDLabel: permanentID(obj),
+			},
+			Annotations: map[string]string{
+				podSecurityPolicyTemplateParentAnnotation:  obj.Name,
+				podSecurityPolicyTemplateVersionAnnotation: obj.ResourceVersion,
+			},
+		},
+		Spec: obj.Spec,
+	}
+
+	if _, err := p.policies.Create(policy); err != nil {
+		return fmt.Errorf("error creating psp: %v", err)
+	}
+
+	return nil
+}
+
+func (p *podSecurityPolicyProvider) ensureClusterRole(obj *v3.PodSecurityPolicyTemplate) error {
+	name := policyName(obj)
+	if _, err := p.clusterRoleLister.Get("", name); err == nil {
+		return nil
+	} else if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error getting cluster role %v: %v", name, err)
+	}
+
+	clusterRole := &rbac.ClusterRole{
+		ObjectMeta: v1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				permanentIDLabel: permanentID(obj),
+			},
+			Annotations: map[string]string{
+				podSecurityPolicyTemplateParentAnnotation:  obj.Name,
+				podSecurityPolicyTemplateVersionAnnotation: obj.ResourceVersion,
+			},
+		},
+		Rules: expectedClusterRoleRules(name),
+	}
+
+	if _, err := p.clusterRoles.Create(clusterRole); err != nil {
+		return fmt.Errorf("error creating cluster role: %v", err)
+	}
+
+	return nil
+}
+
+// Updated patches obj's PodSecurityPolicies that are out of date, but first re-creates the
+// PodSecurityPolicy or ClusterRole if either is missing entirely - e.g. because a prior Create only
+// got partway through - so a template already past ChildCount==0 still ends up with a complete set
+// of children instead of being stuck with whatever the first Create call happened to finish.
+// Existing ClusterRoles are not patched here.
+func (p *podSecurityPolicyProvider) Updated(obj *v3.PodSecurityPolicyTemplate) error {
+	if err := p.ensurePolicy(obj); err != nil {
+		return err
+	}
+	if err := p.ensureClusterRole(obj); err != nil {
+		return err
+	}
+
+	policies, err := p.policyIndexer.ByIndex(policyByPSPTParentAnnotationIndex, permanentID(obj))
+	if err != nil {
+		return fmt.Errorf("error getting policies: %v", err)
+	}
+
+	for _, rawPolicy := range policies {
+		policy := rawPolicy.(*policyv1beta1.PodSecurityPolicy)
+
+		if policy.Annotations[podSecurityPolicyTemplateVersionAnnotation] != obj.ResourceVersion {
+			newPolicy := policy.DeepCopy()
+			newPolicy.Spec = obj.Spec
+			newPolicy.Annotations[podSecurityPolicyTemplateVersionAnnotation] = obj.ResourceVersion
+
+			if _, err := p.policies.Update(newPolicy); err != nil {
+				return fmt.Errorf("error updating psp: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *podSecurityPolicyProvider) Remove(obj *v3.PodSecurityPolicyTemplate) error {
+	policies, err := p.policyIndexer.ByIndex(policyByPSPTParentAnnotationIndex, permanentID(obj))
+	if err != nil {
+		return fmt.Errorf("error getting policies: %v", err)
+	}
+
+	for _, rawPolicy := range policies {
+		policy := rawPolicy.(*policyv1beta1.PodSecurityPolicy)
+		if err := p.policies.Delete(policy.Name, &v1.DeleteOptions{}); err != nil {
+			return fmt.Errorf("error deleting policy: %v", err)
+		}
+	}
+
+	clusterRoles, err := p.clusterRoleIndexer.ByIndex(clusterRoleByPSPTNameIndex, permanentID(obj))
+	if err != nil {
+		return fmt.Errorf("error getting cluster roles: %v", err)
+	}
+
+	for _, rawClusterRole := range clusterRoles {
+		clusterRole := rawClusterRole.(*rbac.ClusterRole)
+		if err := p.clusterRoles.DeleteNamespaced(clusterRole.Namespace, clusterRole.Name, &v1.DeleteOptions{}); err != nil {
+			return fmt.Errorf("error deleting cluster role: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (p *podSecurityPolicyProvider) ChildCount(obj *v3.PodSecurityPolicyTemplate) (int, error) {
+	policies, err := p.policyIndexer.ByIndex(policyByPSPTParentAnnotationIndex, permanentID(obj))
+	if err != nil {
+		return 0, fmt.Errorf("error getting policies: %v", err)
+	}
+
+	clusterRoles, err := p.clusterRoleIndexer.ByIndex(clusterRoleByPSPTNameIndex, permanentID(obj))
+	if err != nil {
+		return 0, fmt.Errorf("error getting cluster roles: %v", err)
+	}
+
+	return len(policies) + len(clusterRoles), nil
+}
+
+// policyByPSPTParentAnnotation indexes PodSecurityPolicies by the permanent-id label stamped on
+// them (see permanentid.go). Despite the name, kept for index-name compatibility, it no longer
+// reads the legacy parent annotation directly; migrate.go backfills the label for objects that
+// still only carry the annotation.
+func policyByPSPTParentAnnotation(obj interface{}) ([]string, error) {
+	policy, ok := obj.(*policyv1beta1.PodSecurityPolicy)
+	if !ok || policy.Labels[permanentIDLabel] == "" {
+		return []string{}, nil
+	}
+
+	return []string{policy.Labels[permanentIDLabel]}, nil
+}
+
+// clusterRoleByPSPTName indexes ClusterRoles by the permanent-id label; see policyByPSPTParentAnnotation.
+func clusterRoleByPSPTName(obj interface{}) ([]string, error) {
+	clusterRole, ok := obj.(*rbac.ClusterRole)
+	if !ok || clusterRole.Labels[permanentIDLabel] == "" {
+		return []string{}, nil
+	}
+
+	return []string{clusterRole.Labels[permanentIDLabel]}, nil
+}
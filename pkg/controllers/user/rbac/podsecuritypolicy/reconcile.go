@@ -0,0 +1,302 @@
+package podsecuritypolicy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	typescorev1 "github.com/rancher/types/apis/core/v1"
+	v3 "github.com/rancher/types/apis/management.cattle.io/v3"
+	v1beta12 "github.com/rancher/types/apis/policy/v1beta1"
+	v12 "github.com/rancher/types/apis/rbac.authorization.k8s.io/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	rbac "k8s.io/api/rbac/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// defaultReconcileInterval is how often drift between a PodSecurityPolicyTemplate and its
+	// derived PodSecurityPolicy/ClusterRole is checked, when reconcileIntervalEnvVar is unset.
+	defaultReconcileInterval = 5 * time.Minute
+
+	// reconcileIntervalEnvVar lets operators override defaultReconcileInterval without a rebuild;
+	// see reconcileIntervalFromEnv.
+	reconcileIntervalEnvVar = "CATTLE_PSPT_RECONCILE_INTERVAL_SECONDS"
+
+	complianceTypeMustHave     = "musthave"
+	complianceTypeMustOnlyHave = "mustonlyhave"
+
+	driftCorrectedEventReason = "PodSecurityPolicyTemplateDriftCorrected"
+)
+
+// reconcileIntervalFromEnv resolves the drift-reconcile interval from reconcileIntervalEnvVar,
+// falling back to defaultReconcileInterval if it's unset or not a positive number of seconds.
+func reconcileIntervalFromEnv() time.Duration {
+	raw := os.Getenv(reconcileIntervalEnvVar)
+	if raw == "" {
+		return defaultReconcileInterval
+	}
+
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds <= 0 {
+		logrus.Errorf("pspt reconcile: invalid %v=%q, using default of %v", reconcileIntervalEnvVar, raw, defaultReconcileInterval)
+		return defaultReconcileInterval
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// reconciler periodically walks every PodSecurityPolicyTemplate's derived PodSecurityPolicy and
+// ClusterRole and corrects drift, in addition to the event-driven sync in Lifecycle.Updated. This
+// catches edits made directly against the derived objects, which never emit a PSPT event.
+type reconciler struct {
+	psptLister v3.PodSecurityPolicyTemplateLister
+
+	policies     v1beta12.PodSecurityPolicyInterface
+	clusterRoles v12.ClusterRoleInterface
+	events       typescorev1.EventInterface
+
+	policyIndexer      cache.Indexer
+	clusterRoleIndexer cache.Indexer
+
+	interval time.Duration
+}
+
+func (r *reconciler) start(ctx context.Context) {
+	go wait.Until(func() { r.reconcileAll() }, r.interval, ctx.Done())
+}
+
+func (r *reconciler) reconcileAll() {
+	templates, err := r.psptLister.List("", labels.Everything())
+	if err != nil {
+		logrus.Errorf("pspt reconcile: error listing pod security policy templates: %v", err)
+		return
+	}
+
+	for _, template := range templates {
+		if err := r.reconcileOne(template); err != nil {
+			logrus.Errorf("pspt reconcile: error reconciling %v: %v", template.Name, err)
+		}
+	}
+}
+
+func (r *reconciler) reconcileOne(obj *v3.PodSecurityPolicyTemplate) error {
+	mode := obj.Spec.ComplianceType
+	if mode == "" {
+		mode = complianceTypeMustHave
+	}
+
+	rawPolicies, err := r.policyIndexer.ByIndex(policyByPSPTParentAnnotationIndex, permanentID(obj))
+	if err != nil {
+		return fmt.Errorf("error getting policies: %v", err)
+	}
+
+	for _, rawPolicy := range rawPolicies {
+		policy := rawPolicy.(*policyv1beta1.PodSecurityPolicy)
+		if err := r.reconcilePolicy(obj, policy, mode); err != nil {
+			return err
+		}
+	}
+
+	rawClusterRoles, err := r.clusterRoleIndexer.ByIndex(clusterRoleByPSPTNameIndex, permanentID(obj))
+	if err != nil {
+		return fmt.Errorf("error getting cluster roles: %v", err)
+	}
+
+	for _, rawClusterRole := range rawClusterRoles {
+		clusterRole := rawClusterRole.(*rbac.ClusterRole)
+		if err := r.reconcileClusterRole(obj, clusterRole, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *reconciler) reconcilePolicy(obj *v3.PodSecurityPolicyTemplate, policy *policyv1beta1.PodSecurityPolicy, mode string) error {
+	spec, annotations, lbls, changed := policyDrift(obj, policy, mode)
+	if !changed {
+		return nil
+	}
+
+	newPolicy := policy.DeepCopy()
+	newPolicy.Spec = spec
+	newPolicy.Annotations = annotations
+	newPolicy.Labels = lbls
+
+	if _, err := r.policies.Update(newPolicy); err != nil {
+		return fmt.Errorf("error correcting drift on policy %v: %v", policy.Name, err)
+	}
+
+	r.recordDriftCorrected(obj, "PodSecurityPolicy", policy.Name)
+	return nil
+}
+
+// policyDrift computes the corrected spec/annotations/labels for policy under obj's compliance
+// mode, without touching the API - so both compliance modes can be covered with plain table-driven
+// tests rather than a fake client. changed is false when policy already matches.
+func policyDrift(obj *v3.PodSecurityPolicyTemplate, policy *policyv1beta1.PodSecurityPolicy, mode string) (spec policyv1beta1.PodSecurityPolicySpec, annotations, labels map[string]string, changed bool) {
+	spec, annotations, labels = policy.Spec, policy.Annotations, policy.Labels
+
+	if !reflect.DeepEqual(policy.Spec, obj.Spec) {
+		spec = obj.Spec
+		changed = true
+	}
+
+	if mode == complianceTypeMustOnlyHave {
+		canonicalAnn := canonicalAnnotations(policy.Annotations)
+		canonicalLbl := canonicalLabels(policy.Labels)
+		if !reflect.DeepEqual(policy.Annotations, canonicalAnn) || !reflect.DeepEqual(policy.Labels, canonicalLbl) {
+			annotations, labels = canonicalAnn, canonicalLbl
+			changed = true
+		}
+	}
+
+	return spec, annotations, labels, changed
+}
+
+func (r *reconciler) reconcileClusterRole(obj *v3.PodSecurityPolicyTemplate, clusterRole *rbac.ClusterRole, mode string) error {
+	rules, annotations, lbls, changed := clusterRoleDrift(obj, clusterRole, mode)
+	if !changed {
+		return nil
+	}
+
+	newClusterRole := clusterRole.DeepCopy()
+	newClusterRole.Rules = rules
+	newClusterRole.Annotations = annotations
+	newClusterRole.Labels = lbls
+
+	if _, err := r.clusterRoles.Update(newClusterRole); err != nil {
+		return fmt.Errorf("error correcting drift on cluster role %v: %v", clusterRole.Name, err)
+	}
+
+	r.recordDriftCorrected(obj, "ClusterRole", clusterRole.Name)
+	return nil
+}
+
+// clusterRoleDrift computes the corrected rules/annotations/labels for clusterRole under obj's
+// compliance mode, without touching the API; see policyDrift. musthave only ever adds rules
+// (mergeRules), while mustonlyhave also resets rules and canonicalizes annotations/labels.
+func clusterRoleDrift(obj *v3.PodSecurityPolicyTemplate, clusterRole *rbac.ClusterRole, mode string) (rules []rbac.PolicyRule, annotations, labels map[string]string, changed bool) {
+	expectedRules := expectedClusterRoleRules(policyName(obj))
+	rules, annotations, labels = clusterRole.Rules, clusterRole.Annotations, clusterRole.Labels
+
+	if mode == complianceTypeMustOnlyHave {
+		if !reflect.DeepEqual(clusterRole.Rules, expectedRules) {
+			rules = expectedRules
+			changed = true
+		}
+		canonicalAnn := canonicalAnnotations(clusterRole.Annotations)
+		canonicalLbl := canonicalLabels(clusterRole.Labels)
+		if !reflect.DeepEqual(clusterRole.Annotations, canonicalAnn) || !reflect.DeepEqual(clusterRole.Labels, canonicalLbl) {
+			annotations, labels = canonicalAnn, canonicalLbl
+			changed = true
+		}
+	} else if !rulesContain(clusterRole.Rules, expectedRules) {
+		rules = mergeRules(clusterRole.Rules, expectedRules)
+		changed = true
+	}
+
+	return rules, annotations, labels, changed
+}
+
+// canonicalAnnotations strips everything off an annotation map except the ones Rancher itself
+// manages, so a mustonlyhave reconcile doesn't clobber them along with operator-added extras.
+func canonicalAnnotations(annotations map[string]string) map[string]string {
+	canonical := map[string]string{}
+	for _, key := range []string{podSecurityPolicyTemplateParentAnnotation, podSecurityPolicyTemplateVersionAnnotation} {
+		if v, ok := annotations[key]; ok {
+			canonical[key] = v
+		}
+	}
+	if len(canonical) == len(annotations) {
+		return annotations
+	}
+	return canonical
+}
+
+// canonicalLabels strips everything off a label map except the ones Rancher itself manages, so a
+// mustonlyhave reconcile doesn't clobber permanentIDLabel along with operator-added extras.
+// permanentIDLabel is kept only when the object already carries it; a missing one is not added.
+func canonicalLabels(labels map[string]string) map[string]string {
+	canonical := map[string]string{}
+	if v, ok := labels[permanentIDLabel]; ok {
+		canonical[permanentIDLabel] = v
+	}
+	if len(canonical) == len(labels) {
+		return labels
+	}
+	return canonical
+}
+
+func expectedClusterRoleRules(policyName string) []rbac.PolicyRule {
+	return []rbac.PolicyRule{
+		{
+			APIGroups:     []string{"policy"},
+			Resources:     []string{"podsecuritypolicies"},
+			ResourceNames: []string{policyName},
+			Verbs:         []string{"use"},
+		},
+	}
+}
+
+func rulesContain(rules, want []rbac.PolicyRule) bool {
+	for _, w := range want {
+		found := false
+		for _, r := range rules {
+			if reflect.DeepEqual(r, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func mergeRules(rules, want []rbac.PolicyRule) []rbac.PolicyRule {
+	merged := append([]rbac.PolicyRule{}, rules...)
+	for _, w := range want {
+		if !rulesContain(merged, []rbac.PolicyRule{w}) {
+			merged = append(merged, w)
+		}
+	}
+	return merged
+}
+
+func policyName(obj *v3.PodSecurityPolicyTemplate) string {
+	return obj.Name
+}
+
+func (r *reconciler) recordDriftCorrected(obj *v3.PodSecurityPolicyTemplate, kind, name string) {
+	event := &corev1.Event{
+		ObjectMeta: v1.ObjectMeta{
+			GenerateName: "pspt-drift-",
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:       "PodSecurityPolicyTemplate",
+			Name:       obj.Name,
+			UID:        types.UID(obj.UID),
+			APIVersion: "management.cattle.io/v3",
+		},
+		Reason:  driftCorrectedEventReason,
+		Message: fmt.Sprintf("corrected drift on %v %v to match template %v", kind, name, obj.Name),
+		Type:    corev1.EventTypeWarning,
+		Source:  corev1.EventSource{Component: "pspt-reconciler"},
+	}
+
+	if _, err := r.events.Create(event); err != nil {
+		logrus.Errorf("pspt reconcile: error recording drift event for %v: %v", obj.Name, err)
+	}
+}
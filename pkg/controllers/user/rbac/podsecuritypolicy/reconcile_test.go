@@ -0,0 +1,167 @@
+package podsecuritypolicy
+
+import (
+	"reflect"
+	"testing"
+
+	v3 "github.com/rancher/types/apis/management.cattle.io/v3"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	rbac "k8s.io/api/rbac/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPolicyDrift(t *testing.T) {
+	templateSpec := policyv1beta1.PodSecurityPolicySpec{Privileged: true}
+	obj := &v3.PodSecurityPolicyTemplate{
+		ObjectMeta: v1.ObjectMeta{Name: "restricted"},
+		Spec:       templateSpec,
+	}
+
+	t.Run("musthave in sync reports no change", func(t *testing.T) {
+		policy := &policyv1beta1.PodSecurityPolicy{Spec: templateSpec}
+
+		_, _, _, changed := policyDrift(obj, policy, complianceTypeMustHave)
+		if changed {
+			t.Errorf("policyDrift() changed = true, want false")
+		}
+	})
+
+	t.Run("musthave corrects spec but leaves operator-added annotations/labels alone", func(t *testing.T) {
+		policy := &policyv1beta1.PodSecurityPolicy{
+			ObjectMeta: v1.ObjectMeta{
+				Annotations: map[string]string{"operator.example.com/owner": "team-a"},
+				Labels:      map[string]string{"operator.example.com/managed": "true"},
+			},
+			Spec: policyv1beta1.PodSecurityPolicySpec{Privileged: false},
+		}
+
+		spec, annotations, labels, changed := policyDrift(obj, policy, complianceTypeMustHave)
+		if !changed {
+			t.Fatalf("policyDrift() changed = false, want true")
+		}
+		if !reflect.DeepEqual(spec, templateSpec) {
+			t.Errorf("policyDrift() spec = %v, want %v", spec, templateSpec)
+		}
+		if !reflect.DeepEqual(annotations, policy.Annotations) || !reflect.DeepEqual(labels, policy.Labels) {
+			t.Errorf("policyDrift() in musthave mode touched annotations/labels: got %v / %v", annotations, labels)
+		}
+	})
+
+	t.Run("mustonlyhave strips operator-added annotations/labels but keeps the managed ones", func(t *testing.T) {
+		policy := &policyv1beta1.PodSecurityPolicy{
+			ObjectMeta: v1.ObjectMeta{
+				Annotations: map[string]string{
+					podSecurityPolicyTemplateParentAnnotation:  "restricted",
+					podSecurityPolicyTemplateVersionAnnotation: "1",
+					"operator.example.com/owner":               "team-a",
+				},
+				Labels: map[string]string{
+					permanentIDLabel:               "some-uuid",
+					"operator.example.com/managed": "true",
+				},
+			},
+			Spec: templateSpec,
+		}
+
+		_, annotations, labels, changed := policyDrift(obj, policy, complianceTypeMustOnlyHave)
+		if !changed {
+			t.Fatalf("policyDrift() changed = false, want true")
+		}
+
+		wantAnnotations := map[string]string{
+			podSecurityPolicyTemplateParentAnnotation:  "restricted",
+			podSecurityPolicyTemplateVersionAnnotation: "1",
+		}
+		wantLabels := map[string]string{permanentIDLabel: "some-uuid"}
+
+		if !reflect.DeepEqual(annotations, wantAnnotations) {
+			t.Errorf("policyDrift() annotations = %v, want %v", annotations, wantAnnotations)
+		}
+		if !reflect.DeepEqual(labels, wantLabels) {
+			t.Errorf("policyDrift() labels = %v, want %v", labels, wantLabels)
+		}
+	})
+
+	t.Run("mustonlyhave already canonical reports no change", func(t *testing.T) {
+		policy := &policyv1beta1.PodSecurityPolicy{
+			ObjectMeta: v1.ObjectMeta{
+				Annotations: map[string]string{podSecurityPolicyTemplateParentAnnotation: "restricted"},
+				Labels:      map[string]string{permanentIDLabel: "some-uuid"},
+			},
+			Spec: templateSpec,
+		}
+
+		_, _, _, changed := policyDrift(obj, policy, complianceTypeMustOnlyHave)
+		if changed {
+			t.Errorf("policyDrift() changed = true, want false")
+		}
+	})
+}
+
+func TestClusterRoleDrift(t *testing.T) {
+	obj := &v3.PodSecurityPolicyTemplate{ObjectMeta: v1.ObjectMeta{Name: "restricted"}}
+	expected := expectedClusterRoleRules(policyName(obj))
+
+	t.Run("musthave merges in missing rules but keeps operator-added ones", func(t *testing.T) {
+		extra := rbac.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}
+		clusterRole := &rbac.ClusterRole{Rules: []rbac.PolicyRule{extra}}
+
+		rules, _, _, changed := clusterRoleDrift(obj, clusterRole, complianceTypeMustHave)
+		if !changed {
+			t.Fatalf("clusterRoleDrift() changed = false, want true")
+		}
+		if !rulesContain(rules, expected) {
+			t.Errorf("clusterRoleDrift() rules %v missing expected %v", rules, expected)
+		}
+		if !rulesContain(rules, []rbac.PolicyRule{extra}) {
+			t.Errorf("clusterRoleDrift() in musthave mode dropped operator-added rule %v: got %v", extra, rules)
+		}
+	})
+
+	t.Run("musthave already containing expected rules reports no change", func(t *testing.T) {
+		clusterRole := &rbac.ClusterRole{Rules: expected}
+
+		_, _, _, changed := clusterRoleDrift(obj, clusterRole, complianceTypeMustHave)
+		if changed {
+			t.Errorf("clusterRoleDrift() changed = true, want false")
+		}
+	})
+
+	t.Run("mustonlyhave resets rules and strips operator-added annotations/labels", func(t *testing.T) {
+		extra := rbac.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}
+		clusterRole := &rbac.ClusterRole{
+			ObjectMeta: v1.ObjectMeta{
+				Annotations: map[string]string{"operator.example.com/owner": "team-a"},
+				Labels:      map[string]string{permanentIDLabel: "some-uuid", "operator.example.com/managed": "true"},
+			},
+			Rules: append([]rbac.PolicyRule{extra}, expected...),
+		}
+
+		rules, annotations, labels, changed := clusterRoleDrift(obj, clusterRole, complianceTypeMustOnlyHave)
+		if !changed {
+			t.Fatalf("clusterRoleDrift() changed = false, want true")
+		}
+		if !reflect.DeepEqual(rules, expected) {
+			t.Errorf("clusterRoleDrift() rules = %v, want %v", rules, expected)
+		}
+		wantLabels := map[string]string{permanentIDLabel: "some-uuid"}
+		if !reflect.DeepEqual(labels, wantLabels) {
+			t.Errorf("clusterRoleDrift() labels = %v, want %v", labels, wantLabels)
+		}
+		if len(annotations) != 0 {
+			t.Errorf("clusterRoleDrift() annotations = %v, want empty", annotations)
+		}
+	})
+
+	t.Run("mustonlyhave already canonical reports no change", func(t *testing.T) {
+		clusterRole := &rbac.ClusterRole{
+			ObjectMeta: v1.ObjectMeta{Labels: map[string]string{permanentIDLabel: "some-uuid"}},
+			Rules:      expected,
+		}
+
+		_, _, _, changed := clusterRoleDrift(obj, clusterRole, complianceTypeMustOnlyHave)
+		if changed {
+			t.Errorf("clusterRoleDrift() changed = true, want false")
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package podsecuritypolicy
+
+// pspRegoAsset is the Rego policy shipped with every Gatekeeper ConstraintTemplate rendered from a
+// PodSecurityPolicyTemplate. It mirrors the subset of policyv1beta1.PodSecurityPolicySpec that
+// Rancher's PSPT UX exposes today, reading its inputs from the Constraint's `parameters` block
+// (see pspSpecToRegoParameters in gatekeeper_provider.go).
+const pspRegoAsset = `
+package pspt
+
+violation[{"msg": msg}] {
+    input.parameters.privileged == false
+    input.review.object.spec.containers[_].securityContext.privileged == true
+    msg := "privileged containers are not allowed"
+}
+
+violation[{"msg": msg}] {
+    input.parameters.readOnlyRootFilesystem == true
+    container := input.review.object.spec.containers[_]
+    container.securityContext.readOnlyRootFilesystem != true
+    msg := sprintf("container %v must set readOnlyRootFilesystem", [container.name])
+}
+
+violation[{"msg": msg}] {
+    input.parameters.hostNetwork == false
+    input.review.object.spec.hostNetwork == true
+    msg := "hostNetwork is not allowed"
+}
+
+violation[{"msg": msg}] {
+    input.parameters.hostPID == false
+    input.review.object.spec.hostPID == true
+    msg := "hostPID is not allowed"
+}
+
+violation[{"msg": msg}] {
+    input.parameters.hostIPC == false
+    input.review.object.spec.hostIPC == true
+    msg := "hostIPC is not allowed"
+}
+
+violation[{"msg": msg}] {
+    input.parameters.runAsUserRule == "MustRunAsNonRoot"
+    container := input.review.object.spec.containers[_]
+    container.securityContext.runAsNonRoot != true
+    msg := sprintf("container %v must set runAsNonRoot", [container.name])
+}
+
+violation[{"msg": msg}] {
+    input.parameters.seLinuxRule == "MustRunAs"
+    container := input.review.object.spec.containers[_]
+    not container.securityContext.seLinuxOptions
+    msg := sprintf("container %v must set seLinuxOptions", [container.name])
+}
+
+violation[{"msg": msg}] {
+    input.parameters.fsGroupRule == "MustRunAs"
+    not input.review.object.spec.securityContext.fsGroup
+    msg := "pod must set securityContext.fsGroup"
+}
+
+violation[{"msg": msg}] {
+    input.parameters.supplementalGroupsRule == "MustRunAs"
+    count(input.review.object.spec.securityContext.supplementalGroups) == 0
+    msg := "pod must set securityContext.supplementalGroups"
+}
+
+violation[{"msg": msg}] {
+    count(input.parameters.allowedCapabilities) > 0
+    container := input.review.object.spec.containers[_]
+    added := container.securityContext.capabilities.add[_]
+    not allowed_capability(added)
+    msg := sprintf("container %v adds disallowed capability %v", [container.name, added])
+}
+
+allowed_capability(cap) {
+    input.parameters.allowedCapabilities[_] == cap
+}
+
+violation[{"msg": msg}] {
+    count(input.parameters.volumes) > 0
+    volume := input.review.object.spec.volumes[_]
+    not allowed_volume(volume)
+    msg := sprintf("volume %v uses a disallowed volume type", [volume.name])
+}
+
+allowed_volume(volume) {
+    kind := volume_kind(volume)
+    input.parameters.volumes[_] == kind
+}
+
+volume_kind(volume) = kind {
+    keys := [k | volume[k]; k != "name"]
+    kind := keys[0]
+}
+`
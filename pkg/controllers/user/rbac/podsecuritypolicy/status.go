@@ -0,0 +1,107 @@
+package podsecuritypolicy
+
+import (
+	"time"
+
+	v3 "github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// Status conditions surfaced per cluster in PodSecurityPolicyTemplate.Status.Clusters. They exist
+// so operators can tell, from the PSPT alone, whether a downstream cluster is still reconciling
+// without having to go inspect that cluster's PodSecurityPolicy/ClusterRole/Constraints directly.
+const (
+	ConditionSynced    = "Synced"
+	ConditionOutOfSync = "OutOfSync"
+	ConditionError     = "Error"
+)
+
+// recordClusterStatus upserts this controller's cluster entry into obj.Status.Clusters and writes
+// it back through the status subresource, returning the object UpdateStatus produced. The status
+// write bumps obj's ResourceVersion server-side, so callers that go on to persist further changes
+// to the same object - like Lifecycle.Updated's finalizer/label write - must continue from the
+// returned object rather than the one passed in, or they'll conflict against the ResourceVersion
+// this status write just advanced past. syncErr, if non-nil, is recorded as an Error condition. A
+// failed status write is only logged, and obj is returned unchanged, so the status write is never
+// the reason a PSPT sync is reported as failed.
+func (l *Lifecycle) recordClusterStatus(obj *v3.PodSecurityPolicyTemplate, childCount int, syncErr error) *v3.PodSecurityPolicyTemplate {
+	entry := v3.PodSecurityPolicyTemplateClusterStatus{
+		ClusterName:        l.clusterName,
+		ObservedGeneration: obj.Generation,
+		LastSyncTime:       time.Now().Format(time.RFC3339),
+	}
+
+	if policyName, clusterRoleName, ok := l.childNames(obj); ok {
+		entry.PolicyName = policyName
+		entry.ClusterRoleName = clusterRoleName
+	}
+
+	switch {
+	case syncErr != nil:
+		entry.Condition = ConditionError
+		entry.Message = syncErr.Error()
+	case childCount == 0:
+		entry.Condition = ConditionOutOfSync
+		entry.Message = "no derived objects found for this template yet"
+	default:
+		entry.Condition = ConditionSynced
+		entry.Message = ""
+	}
+
+	newObj := obj.DeepCopy()
+	newObj.Status.Clusters = upsertClusterStatus(newObj.Status.Clusters, entry)
+
+	updated, err := l.pspti.UpdateStatus(newObj)
+	if err != nil {
+		logrus.Errorf("error updating status for pod security policy template %v: %v", obj.Name, err)
+		return obj
+	}
+	return updated
+}
+
+// childNames best-effort resolves the names of this cluster's derived PodSecurityPolicy and
+// ClusterRole for display in status; it only has an answer when the active provider is the
+// PodSecurityPolicy provider, since Gatekeeper's Constraints don't have those names.
+func (l *Lifecycle) childNames(obj *v3.PodSecurityPolicyTemplate) (policyName, clusterRoleName string, ok bool) {
+	provider, err := l.provider()
+	if err != nil {
+		return "", "", false
+	}
+
+	psp, ok := provider.(*podSecurityPolicyProvider)
+	if !ok {
+		return "", "", false
+	}
+
+	rawPolicies, err := psp.policyIndexer.ByIndex(policyByPSPTParentAnnotationIndex, permanentID(obj))
+	if err != nil || len(rawPolicies) == 0 {
+		return "", "", false
+	}
+
+	rawClusterRoles, err := psp.clusterRoleIndexer.ByIndex(clusterRoleByPSPTNameIndex, permanentID(obj))
+	if err != nil || len(rawClusterRoles) == 0 {
+		return "", "", false
+	}
+
+	return objectName(rawPolicies[0]), objectName(rawClusterRoles[0]), true
+}
+
+func objectName(obj interface{}) string {
+	type named interface {
+		GetName() string
+	}
+	if n, ok := obj.(named); ok {
+		return n.GetName()
+	}
+	return ""
+}
+
+func upsertClusterStatus(clusters []v3.PodSecurityPolicyTemplateClusterStatus, entry v3.PodSecurityPolicyTemplateClusterStatus) []v3.PodSecurityPolicyTemplateClusterStatus {
+	for i, existing := range clusters {
+		if existing.ClusterName == entry.ClusterName {
+			clusters[i] = entry
+			return clusters
+		}
+	}
+	return append(clusters, entry)
+}
@@ -7,13 +7,8 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 
 	v3 "github.com/rancher/types/apis/management.cattle.io/v3"
-	v1beta12 "github.com/rancher/types/apis/policy/v1beta1"
-	v12 "github.com/rancher/types/apis/rbac.authorization.k8s.io/v1"
 	"github.com/rancher/types/config"
 	"github.com/sirupsen/logrus"
-	policyv1beta1 "k8s.io/api/policy/v1beta1"
-	rbac "k8s.io/api/rbac/v1"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
@@ -37,7 +32,7 @@ func RegisterTemplate(ctx context.Context, context *config.UserContext) {
 	}
 	clusterRoleInformer.AddIndexers(clusterRoleIndexer)
 
-	lfc := &Lifecycle{
+	pspProvider := &podSecurityPolicyProvider{
 		policies:          context.Policy.PodSecurityPolicies(""),
 		policyLister:      context.Policy.PodSecurityPolicies("").Controller().Lister(),
 		clusterRoles:      context.RBAC.ClusterRoles(""),
@@ -47,93 +42,156 @@ func RegisterTemplate(ctx context.Context, context *config.UserContext) {
 		clusterRoleIndexer: clusterRoleInformer.GetIndexer(),
 	}
 
+	providers := []PolicyProvider{pspProvider}
+
+	// The Gatekeeper provider talks to CRDs that aren't always installed on a cluster, so it's
+	// wired up best-effort: a cluster that hasn't installed Gatekeeper simply never selects it.
+	if dynamicClient := context.UnstructuredClient(); dynamicClient != nil {
+		constraintInformer := context.UnstructuredClient().Controller().Informer()
+		constraintIndexers := map[string]cache.IndexFunc{
+			constraintByPSPTParentIndex: constraintByPSPTParent,
+		}
+		constraintInformer.AddIndexers(constraintIndexers)
+
+		providers = append(providers, &gatekeeperProvider{
+			client:            dynamicClient,
+			constraintIndexer: constraintInformer.GetIndexer(),
+		})
+	}
+
 	pspti := context.Management.Management.PodSecurityPolicyTemplates("")
+
+	lfc := &Lifecycle{
+		providers:     providers,
+		clusterLister: context.Management.Management.Clusters("").Controller().Lister(),
+		clusterName:   context.ClusterName,
+		pspti:         pspti,
+	}
+
 	psptSync := v3.NewPodSecurityPolicyTemplateLifecycleAdapter("cluster-pspt-sync_"+context.ClusterName, true, pspti, lfc)
 	context.Management.Management.PodSecurityPolicyTemplates("").AddHandler(ctx, "pspt-sync", psptSync)
+
+	rec := &reconciler{
+		psptLister:         pspti.Controller().Lister(),
+		policies:           context.Policy.PodSecurityPolicies(""),
+		clusterRoles:       context.RBAC.ClusterRoles(""),
+		events:             context.Core.Events(""),
+		policyIndexer:      policyInformer.GetIndexer(),
+		clusterRoleIndexer: clusterRoleInformer.GetIndexer(),
+		interval:           ReconcileInterval,
+	}
+	rec.start(ctx)
+
+	registerDeploymentSweeper(ctx, context.ClusterName, rancherDeployments(context), rancherDeploymentController(context), pspti.Controller().Lister(), pspti, providers)
+
+	if err := migratePermanentIDs(pspti, pspti.Controller().Lister(),
+		context.Policy.PodSecurityPolicies(""), context.Policy.PodSecurityPolicies("").Controller().Lister(),
+		context.RBAC.ClusterRoles(""), context.RBAC.ClusterRoles("").Controller().Lister()); err != nil {
+		logrus.Errorf("error backfilling permanent-id labels: %v", err)
+	}
 }
 
-type Lifecycle struct {
-	policies          v1beta12.PodSecurityPolicyInterface
-	policyLister      v1beta12.PodSecurityPolicyLister
-	clusterRoles      v12.ClusterRoleInterface
-	clusterRoleLister v12.ClusterRoleLister
+// ReconcileInterval controls how often the drift reconciler in reconcile.go resyncs derived
+// PodSecurityPolicies and ClusterRoles against their PodSecurityPolicyTemplate. Resolved once at
+// startup from reconcileIntervalEnvVar, falling back to defaultReconcileInterval.
+var ReconcileInterval = reconcileIntervalFromEnv()
 
-	policyIndexer      cache.Indexer
-	clusterRoleIndexer cache.Indexer
+type Lifecycle struct {
+	providers     []PolicyProvider
+	clusterLister v3.ClusterLister
+	clusterName   string
+	pspti         v3.PodSecurityPolicyTemplateInterface
 }
 
 func (l *Lifecycle) Create(obj *v3.PodSecurityPolicyTemplate) (runtime.Object, error) {
-	return nil, nil
+	return ensurePSPTFinalizer(ensurePermanentID(obj)), nil
 }
 
+// Updated propagates obj to whichever PolicyProvider is active for this cluster, then records the
+// outcome in obj.Status.Clusters (see status.go) so operators can see propagation health for this
+// cluster without inspecting its PodSecurityPolicy/ClusterRole/Constraints directly. A sync error
+// is recorded there as well as returned, so the handler still retries on failure.
+//
+// A template with no children yet for this provider - either brand new, or previously synced by a
+// provider this cluster no longer uses - is created rather than updated; Create is idempotent to
+// retry from Lifecycle.Create never having run (e.g. a crash between Create and the first Updated).
 func (l *Lifecycle) Updated(obj *v3.PodSecurityPolicyTemplate) (runtime.Object, error) {
-	policies, err := l.policyIndexer.ByIndex(policyByPSPTParentAnnotationIndex, obj.Name)
+	obj = ensurePermanentID(obj)
+
+	provider, err := l.provider()
 	if err != nil {
-		return nil, fmt.Errorf("error getting policies: %v", err)
+		return nil, err
 	}
 
-	for _, rawPolicy := range policies {
-		policy := rawPolicy.(*policyv1beta1.PodSecurityPolicy)
+	existing, countErr := provider.ChildCount(obj)
+	if countErr != nil {
+		return nil, countErr
+	}
 
-		if policy.Annotations[podSecurityPolicyTemplateVersionAnnotation] != obj.ResourceVersion {
-			newPolicy := policy.DeepCopy()
-			newPolicy.Spec = obj.Spec
-			newPolicy.Annotations[podSecurityPolicyTemplateVersionAnnotation] = obj.ResourceVersion
+	var syncErr error
+	if existing == 0 {
+		syncErr = provider.Create(obj)
+	} else {
+		syncErr = provider.Updated(obj)
+	}
 
-			_, err = l.policies.Update(newPolicy)
-			if err != nil {
-				return nil, fmt.Errorf("error updating psp: %v", err)
-			}
-		}
+	childCount, countErr := provider.ChildCount(obj)
+	if countErr != nil && syncErr == nil {
+		syncErr = countErr
+	}
+
+	// recordClusterStatus's status-subresource write advances obj's ResourceVersion server-side;
+	// continue from the object it returns so the finalizer write below lands on top of that, not a
+	// now-stale ResourceVersion that would conflict with the status write.
+	obj = l.recordClusterStatus(obj, childCount, syncErr)
+
+	if syncErr != nil {
+		return nil, syncErr
 	}
 
-	return obj, nil
+	return ensurePSPTFinalizer(obj), nil
 }
 
+// Remove only releases pspCleanupFinalizerKey once the provider active for this cluster confirms it
+// has no children left for obj (children of other providers are not checked here), so a crash between deleting a child and clearing the finalizer is safely retried on the
+// next Remove call instead of orphaning whatever didn't get deleted.
 func (l *Lifecycle) Remove(obj *v3.PodSecurityPolicyTemplate) (runtime.Object, error) {
-	policies, err := l.policyIndexer.ByIndex(policyByPSPTParentAnnotationIndex, obj.Name)
+	provider, err := l.provider()
 	if err != nil {
-		return nil, fmt.Errorf("error getting policies: %v", err)
+		return nil, err
 	}
 
-	for _, rawPolicy := range policies {
-		policy := rawPolicy.(*policyv1beta1.PodSecurityPolicy)
-		err = l.policies.Delete(policy.Name, &v1.DeleteOptions{})
-		if err != nil {
-			return nil, fmt.Errorf("error deleting policy: %v", err)
-		}
+	if err := provider.Remove(obj); err != nil {
+		return nil, err
 	}
 
-	clusterRoles, err := l.clusterRoleIndexer.ByIndex(clusterRoleByPSPTNameIndex, obj.Name)
+	count, err := provider.ChildCount(obj)
 	if err != nil {
-		return nil, fmt.Errorf("error getting cluster roles: %v", err)
+		return nil, err
 	}
 
-	for _, rawClusterRole := range clusterRoles {
-		clusterRole := rawClusterRole.(*rbac.ClusterRole)
-		err = l.clusterRoles.DeleteNamespaced(clusterRole.Namespace, clusterRole.Name, &v1.DeleteOptions{})
-		if err != nil {
-			return nil, fmt.Errorf("error deleting cluster role: %v", err)
-		}
+	finalizers, err := finalizeRemoval(obj.Name, obj.Finalizers, provider.Name(), count)
+	if err != nil {
+		return nil, err
 	}
 
-	return obj, nil
+	newObj := obj.DeepCopy()
+	newObj.Finalizers = finalizers
+	return newObj, nil
 }
 
-func policyByPSPTParentAnnotation(obj interface{}) ([]string, error) {
-	policy, ok := obj.(*policyv1beta1.PodSecurityPolicy)
-	if !ok || policy.Annotations[podSecurityPolicyTemplateParentAnnotation] == "" {
-		return []string{}, nil
+// provider resolves the PolicyProvider configured on this controller's cluster, defaulting to the
+// PodSecurityPolicy provider for clusters that haven't opted into anything else.
+func (l *Lifecycle) provider() (PolicyProvider, error) {
+	cluster, err := l.clusterLister.Get("", l.clusterName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting cluster %v: %v", l.clusterName, err)
 	}
 
-	return []string{policy.Annotations[podSecurityPolicyTemplateParentAnnotation]}, nil
-}
-
-func clusterRoleByPSPTName(obj interface{}) ([]string, error) {
-	clusterRole, ok := obj.(*rbac.ClusterRole)
-	if !ok || clusterRole.Annotations[podSecurityPolicyTemplateParentAnnotation] == "" {
-		return []string{}, nil
+	provider := activeProvider(l.providers, cluster.Spec.PodSecurityPolicyTemplateProvider)
+	if provider == nil {
+		return nil, fmt.Errorf("no policy provider available for cluster %v", l.clusterName)
 	}
 
-	return []string{clusterRole.Annotations[podSecurityPolicyTemplateParentAnnotation]}, nil
+	return provider, nil
 }